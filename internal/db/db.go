@@ -6,37 +6,116 @@ import (
 	"database/sql"
 	"fmt"
 	"log/slog"
-	"strings"
 	"time"
 
-	// TODO(jbarkhuysen): Consider switching to pgx instead.
-	_ "github.com/lib/pq" // Postgres driver.
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/pgx/v5/stdlib"
 )
 
+// Queryer is satisfied by both *pgxpool.Pool and pgx.Tx, so DB methods can
+// run either directly against the pool or composed inside a caller-supplied
+// transaction via View/Update.
+type Queryer interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+}
+
+// Clock returns the current time. It exists so tests can inject a fake
+// clock instead of depending on wall-clock time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
 // A db handle with specialised logic for indexing.
+//
+// TODO(jbarkhuysen): dialect is currently always DialectPostgres; pool is a
+// *pgxpool.Pool, which only speaks Postgres. Wiring DialectMySQL/DialectSQLite
+// all the way through means giving DB a database/sql-backed Queryer for
+// those dialects (NewDB would take one or the other, not both). Until then,
+// the dialect-aware query builders in dialect.go are exercised by query
+// composition alone, not by an actual MySQL/SQLite connection.
 type DB struct {
-	db *sql.DB
+	pool    *pgxpool.Pool
+	dialect Dialect
+	clock   Clock
 }
 
-func Connect(ctx context.Context, username, password, host string, port uint16, dbname string) (*sql.DB, error) {
+func Connect(ctx context.Context, username, password, host string, port uint16, dbname string) (*pgxpool.Pool, error) {
 	connStr := fmt.Sprintf("postgres://%s:%s@%s:%d/%s?sslmode=disable", username, password, host, port, dbname)
-	db, err := sql.Open("postgres", connStr)
-	if err != nil {
-		return nil, err
-	}
 
 	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
 	defer cancel()
 
-	if err := db.PingContext(ctx); err != nil {
+	pool, err := pgxpool.New(ctx, connStr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := pool.Ping(ctx); err != nil {
+		pool.Close()
 		return nil, fmt.Errorf("error pinging db: %v", err)
 	}
 
-	return db, nil
+	return pool, nil
+}
+
+// OpenDBFromPool returns a *sql.DB backed by pool, for tools (such as the
+// migration runner) that require the standard library interface.
+func OpenDBFromPool(pool *pgxpool.Pool) *sql.DB {
+	return stdlib.OpenDBFromPool(pool)
+}
+
+func NewDB(pool *pgxpool.Pool) *DB {
+	return &DB{pool: pool, dialect: DialectPostgres, clock: realClock{}}
 }
 
-func NewDB(db *sql.DB) *DB {
-	return &DB{db: db}
+// NewDBWithClock is like NewDB but lets the caller supply a Clock, so tests
+// can control what "now" means without sleeping or depending on wall-clock
+// time.
+func NewDBWithClock(pool *pgxpool.Pool, clock Clock) *DB {
+	return &DB{pool: pool, dialect: DialectPostgres, clock: clock}
+}
+
+// View runs fn against a read-only snapshot of the database, so multiple
+// reads (e.g. pulling work from the queue alongside other lookups) observe a
+// consistent point in time.
+func (d *DB) View(ctx context.Context, fn func(q Queryer) error) error {
+	tx, err := d.pool.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("View: failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// Update runs fn inside a read-write transaction, committing if fn returns
+// nil and rolling back otherwise. It lets callers compose several DB methods
+// (e.g. pulling work and writing its results) into one atomic unit.
+func (d *DB) Update(ctx context.Context, fn func(q Queryer) error) error {
+	tx, err := d.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("Update: failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback(ctx)
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("Update: failed to commit transaction: %v", err)
+	}
+	return nil
 }
 
 type Repo struct {
@@ -61,6 +140,7 @@ type RepoPR struct {
 	Number    int                    // The PR number.
 	Created   *time.Time             // When the PR was created.
 	Merged    *time.Time             // When the PR was merged (nil if not merged).
+	UpdatedAt *time.Time             // GitHub's updated_at; drives incremental reindexing via IndexCursorKindPRs.
 	Reviewers []*RepoPRReviewerStats // The reviewers for the PR.
 }
 
@@ -72,77 +152,215 @@ type RepoPRReviewerStats struct {
 }
 
 // Retrieves from the work queue whether it's time to re-index all repos.
-func (d *DB) NextReindexAllReposWork(ctx context.Context, reindexTTL, reindexPeriod time.Duration) (shouldReindex bool, _ error) {
+// workerID identifies the caller claiming the lease, recorded alongside the
+// claim so a stalled worker shows up in ListStalledIndexingJobs instead of
+// being invisible.
+func (d *DB) NextReindexAllReposWork(ctx context.Context, q Queryer, workerID string, reindexTTL, reindexPeriod time.Duration) (shouldReindex bool, _ error) {
+	now := d.clock.Now()
+	ttlDeadline := now.Add(-reindexTTL)       // A lease taken before this is stale and can be stolen.
+	periodDeadline := now.Add(-reindexPeriod) // Work finished before this is due for a re-index.
+
 	query := `
+WITH previous AS (
+    SELECT indexing_worker_id, indexing_began, indexing_finished
+    FROM repo_indexing
+)
 UPDATE repo_indexing
-SET indexing_began = NOW()
-WHERE indexing_began + ($1 * INTERVAL '1 SECOND') < NOW()
-AND indexing_finished + ($2 * INTERVAL '1 SECOND') < NOW();`
-	id, err := d.db.ExecContext(ctx, query, int64(reindexTTL.Seconds()), int64(reindexPeriod.Seconds()))
+SET indexing_began = $3, indexing_worker_id = $4, indexing_attempts = indexing_attempts + 1
+WHERE indexing_began < $1
+AND indexing_finished < $2
+RETURNING
+    (SELECT indexing_worker_id FROM previous),
+    (SELECT indexing_began FROM previous),
+    (SELECT indexing_finished FROM previous),
+    indexing_attempts;`
+	var previousWorkerID *string
+	var previousBegan, previousFinished time.Time
+	var attempts int
+	err := q.QueryRow(ctx, query, ttlDeadline, periodDeadline, now, workerID).Scan(&previousWorkerID, &previousBegan, &previousFinished, &attempts)
 	if err != nil {
+		if err == pgx.ErrNoRows {
+			return false, nil
+		}
 		return false, fmt.Errorf("NextReindexAllReposWork:\nquery: %s\nerror: %v", query, err)
 	}
-	a, err := id.RowsAffected()
-	if err != nil {
-		return false, fmt.Errorf("NextReindexAllReposWork: %v", err)
-	}
-	return a > 0, nil
+	logLeaseEvent(workerID, previousWorkerID, previousBegan, previousFinished, now, attempts)
+	return true, nil
 }
 
 // Retrieves from the work queue the next repo for which to re-index (both PRs and commits).
-// workWasFound will be false if no work was found.
-func (d *DB) NextReindexRepoWork(ctx context.Context, reindexTTL, reindexPeriod time.Duration) (repoID int64, repoToReindex, defaultBranchName string, workWasFound bool, _ error) {
+// workWasFound will be false if no work was found. workerID identifies the
+// caller claiming the lease, recorded alongside the claim so a stalled
+// worker shows up in ListStalledIndexingJobs instead of being invisible.
+func (d *DB) NextReindexRepoWork(ctx context.Context, q Queryer, workerID string, reindexTTL, reindexPeriod time.Duration) (repoID int64, repoToReindex, defaultBranchName string, workWasFound bool, _ error) {
+	now := d.clock.Now()
+	ttlDeadline := now.Add(-reindexTTL)       // A lease taken before this is stale and can be stolen.
+	periodDeadline := now.Add(-reindexPeriod) // Work finished before this is due for a re-index.
+
 	query := `
-UPDATE repos
-SET indexing_began = NOW()
-WHERE repo_id = (
-    SELECT repo_id
+WITH candidate AS (
+    SELECT repo_id, indexing_worker_id, indexing_began, indexing_finished
     FROM repos
-    WHERE indexing_began + ($1 * INTERVAL '1 SECOND') < NOW()
-    AND indexing_finished + ($2 * INTERVAL '1 SECOND') < NOW()
+    WHERE indexing_began < $1
+    AND indexing_finished < $2
     ORDER BY indexing_finished ASC
     LIMIT 1
 )
-RETURNING repo_id, org_repo_name, default_branch_name;`
+UPDATE repos
+SET indexing_began = $3, indexing_worker_id = $4, indexing_attempts = indexing_attempts + 1
+WHERE repo_id = (SELECT repo_id FROM candidate)
+RETURNING
+    repo_id, org_repo_name, default_branch_name, indexing_attempts,
+    (SELECT indexing_worker_id FROM candidate),
+    (SELECT indexing_began FROM candidate),
+    (SELECT indexing_finished FROM candidate);`
 
-	row := d.db.QueryRowContext(ctx, query, int64(reindexTTL.Seconds()), int64(reindexPeriod.Seconds()))
-	if row.Err() != nil {
-		return 0, "", "", false, fmt.Errorf("NextReindexRepoWork:\nquery: %s\nerror: %v", query, row.Err())
-	}
 	var rID int64
 	var rName, rBranch string
-	if err := row.Scan(&rID, &rName, &rBranch); err != nil {
-		if err == sql.ErrNoRows {
+	var attempts int
+	var previousWorkerID *string
+	var previousBegan, previousFinished time.Time
+	err := q.QueryRow(ctx, query, ttlDeadline, periodDeadline, now, workerID).Scan(
+		&rID, &rName, &rBranch, &attempts, &previousWorkerID, &previousBegan, &previousFinished)
+	if err != nil {
+		if err == pgx.ErrNoRows {
 			return 0, "", "", false, nil
 		}
-		return 0, "", "", false, fmt.Errorf("NextReindexRepoWork: %v", err)
+		return 0, "", "", false, fmt.Errorf("NextReindexRepoWork:\nquery: %s\nerror: %v", query, err)
 	}
+	logLeaseEvent(workerID, previousWorkerID, previousBegan, previousFinished, now, attempts)
 	return rID, rName, rBranch, true, nil
 }
 
+// logLeaseEvent emits a structured slog event describing a lease claim made
+// by NextReindexAllReposWork/NextReindexRepoWork, so an operator can wire
+// event=lease_acquired/lease_stolen to Prometheus via an slog handler.
+// There's no corresponding lease_released here: that event belongs wherever
+// indexing_finished is written, which isn't in this package today.
+func logLeaseEvent(workerID string, previousWorkerID *string, previousBegan, previousFinished, now time.Time, attempts int) {
+	event := "lease_acquired"
+	// previousBegan after previousFinished means the prior holder started
+	// but never finished before we matched its TTL: we're taking over a
+	// stalled lease rather than picking up the next period's fresh work.
+	if previousWorkerID != nil && previousBegan.After(previousFinished) {
+		event = "lease_stolen"
+	}
+	attrs := []any{"event", event, "worker_id", workerID, "attempts", attempts}
+	if previousWorkerID != nil {
+		attrs = append(attrs, "previous_worker_id", *previousWorkerID, "previous_lease_duration", now.Sub(previousBegan))
+	}
+	slog.Info("reindex lease", attrs...)
+}
+
+// StalledIndexingJob describes a repo whose indexing lease has outlived
+// olderThan without finishing, as returned by ListStalledIndexingJobs.
+type StalledIndexingJob struct {
+	RepoID   int64
+	WorkerID string
+	Attempts int
+	Began    time.Time
+}
+
+// ListStalledIndexingJobs returns every repo that started indexing but never
+// finished, and whose lease was claimed more than olderThan ago, so an
+// operator can alert on "reindex has been running for 3x the TTL" instead of
+// only being able to see the current work-queue state.
+func (d *DB) ListStalledIndexingJobs(ctx context.Context, q Queryer, olderThan time.Duration) ([]*StalledIndexingJob, error) {
+	cutoff := d.clock.Now().Add(-olderThan)
+
+	query := `
+SELECT repo_id, indexing_worker_id, indexing_attempts, indexing_began
+FROM repos
+WHERE indexing_began > indexing_finished
+AND indexing_began < $1;`
+	rows, err := q.Query(ctx, query, cutoff)
+	if err != nil {
+		return nil, fmt.Errorf("ListStalledIndexingJobs:\nquery: %s\nerror: %v", query, err)
+	}
+	defer rows.Close()
+
+	var jobs []*StalledIndexingJob
+	for rows.Next() {
+		job := &StalledIndexingJob{}
+		var workerID *string
+		if err := rows.Scan(&job.RepoID, &workerID, &job.Attempts, &job.Began); err != nil {
+			return nil, fmt.Errorf("ListStalledIndexingJobs: failed to scan row: %v", err)
+		}
+		if workerID != nil {
+			job.WorkerID = *workerID
+		}
+		jobs = append(jobs, job)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("ListStalledIndexingJobs: %v", err)
+	}
+	return jobs, nil
+}
+
 // Store the given repos. Afterwards, they will be ready for repo tag indexing.
 // Updates the RepoID field in each repo struct with the database-assigned ID.
+// The whole batch is upserted in one statement via unnest, so it's atomic
+// without needing an explicit transaction.
 //
 // TODO(jbarkhuysen): The given orgRepoNames should be treated as authoratative.
 // Any repos in GitHub not in this list should be deleted (and their repo tags).
-func (d *DB) StoreRepos(ctx context.Context, repos []*Repo) error {
+func (d *DB) StoreRepos(ctx context.Context, q Queryer, repos []*Repo) error {
 	if len(repos) == 0 {
 		return fmt.Errorf("StoreRepos called with 0 repos")
 	}
 
-	// Insert or update each repo and get back the repo_id
+	// Deduplicate by OrgRepoName (last one wins, matching the old per-row
+	// loop's behavior) before building the unnest arrays: the upsert below
+	// fails with "ON CONFLICT DO UPDATE command cannot affect row a second
+	// time" if the same name appears twice in one batch.
+	defaultBranchNameByOrgRepoName := make(map[string]string, len(repos))
+	var orgRepoNames []string
 	for _, repo := range repos {
-		query := `
+		if _, ok := defaultBranchNameByOrgRepoName[repo.OrgRepoName]; !ok {
+			orgRepoNames = append(orgRepoNames, repo.OrgRepoName)
+		}
+		defaultBranchNameByOrgRepoName[repo.OrgRepoName] = repo.DefaultBranchName
+	}
+	defaultBranchNames := make([]string, len(orgRepoNames))
+	for i, name := range orgRepoNames {
+		defaultBranchNames[i] = defaultBranchNameByOrgRepoName[name]
+	}
+
+	// StoreRepos is only exercised against the Postgres dialect today (see
+	// the TODO on DB). The placeholders and the upsert suffix are generated
+	// per-dialect, but unnest, the ::text[] casts and RETURNING are
+	// Postgres-only, so the query is not valid MySQL or SQLite.
+	query := fmt.Sprintf(`
 INSERT INTO repos (org_repo_name, default_branch_name)
-VALUES ($1, $2)
-ON CONFLICT (org_repo_name) 
-DO UPDATE SET default_branch_name = EXCLUDED.default_branch_name
-RETURNING repo_id;`
+SELECT * FROM unnest(%s::text[], %s::text[])
+%s
+RETURNING repo_id, org_repo_name;`,
+		d.dialect.placeholder(1), d.dialect.placeholder(2),
+		d.dialect.upsertSuffix("org_repo_name", []string{"default_branch_name"}))
+
+	rows, err := q.Query(ctx, query, orgRepoNames, defaultBranchNames)
+	if err != nil {
+		return fmt.Errorf("StoreRepos:\nquery: %s\nerror: %v", query, err)
+	}
+	defer rows.Close()
 
+	repoIDByName := make(map[string]int64, len(repos))
+	for rows.Next() {
 		var repoID int64
-		err := d.db.QueryRowContext(ctx, query, repo.OrgRepoName, repo.DefaultBranchName).Scan(&repoID)
-		if err != nil {
-			return fmt.Errorf("StoreRepos for %s:\nquery: %s\nerror: %v", repo.OrgRepoName, query, err)
+		var orgRepoName string
+		if err := rows.Scan(&repoID, &orgRepoName); err != nil {
+			return fmt.Errorf("StoreRepos: failed to scan row: %v", err)
+		}
+		repoIDByName[orgRepoName] = repoID
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("StoreRepos: %v", err)
+	}
+
+	for _, repo := range repos {
+		repoID, ok := repoIDByName[repo.OrgRepoName]
+		if !ok {
+			return fmt.Errorf("StoreRepos: no repo_id returned for %s", repo.OrgRepoName)
 		}
 		repo.RepoID = repoID
 	}
@@ -152,129 +370,326 @@ RETURNING repo_id;`
 	return nil
 }
 
+// IndexCursorKind identifies which kind of incremental cursor a
+// repo_indexing_cursor row tracks.
+type IndexCursorKind string
+
+const (
+	IndexCursorKindCommits IndexCursorKind = "commits"
+	IndexCursorKindPRs     IndexCursorKind = "prs"
+)
+
+// GetIndexCursor returns the high-water mark from the last successful
+// reindex of kind for repoID: sinceTime is the newest commit/PR timestamp
+// seen, and sinceIDOrNumber is its commit SHA (for IndexCursorKindCommits)
+// or PR number (for IndexCursorKindPRs). If no cursor has been recorded yet,
+// it returns the zero time and an empty string so callers fall back to a
+// full scan.
+func (d *DB) GetIndexCursor(ctx context.Context, q Queryer, repoID int64, kind IndexCursorKind) (sinceTime time.Time, sinceIDOrNumber string, _ error) {
+	query := `
+SELECT since_time, since_id
+FROM repo_indexing_cursor
+WHERE repo_id = $1 AND kind = $2;`
+	err := q.QueryRow(ctx, query, repoID, string(kind)).Scan(&sinceTime, &sinceIDOrNumber)
+	if err != nil {
+		if err == pgx.ErrNoRows {
+			return time.Time{}, "", nil
+		}
+		return time.Time{}, "", fmt.Errorf("GetIndexCursor:\nquery: %s\nerror: %v", query, err)
+	}
+	return sinceTime, sinceIDOrNumber, nil
+}
+
+// AdvanceIndexCursor records the new high-water mark for kind on repoID, but
+// only if newHigh is actually newer than what's stored: the WHERE clause on
+// the upsert's DO UPDATE makes this a no-op (not an overwrite) whenever
+// newHigh doesn't move the cursor forward. That keeps a batch that doesn't
+// contain the globally-newest commit/PR (a backfill, a retried or
+// out-of-order page, two concurrent Store* calls racing) from rewinding a
+// cursor that's already ahead of it.
+func (d *DB) AdvanceIndexCursor(ctx context.Context, q Queryer, repoID int64, kind IndexCursorKind, newHigh time.Time, newSHAOrNumber string) error {
+	query := `
+INSERT INTO repo_indexing_cursor (repo_id, kind, since_time, since_id)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (repo_id, kind) DO UPDATE SET
+    since_time = EXCLUDED.since_time,
+    since_id = EXCLUDED.since_id
+WHERE repo_indexing_cursor.since_time < EXCLUDED.since_time;`
+	if _, err := q.Exec(ctx, query, repoID, string(kind), newHigh, newSHAOrNumber); err != nil {
+		return fmt.Errorf("AdvanceIndexCursor:\nquery: %s\nerror: %v", query, err)
+	}
+	return nil
+}
+
+// dedupeCommitsBySHA collapses repoCommits down to one entry per commit_sha,
+// keeping the last occurrence, so a batch with two rows for the same SHA
+// (reachable from two branches, an overlapping/retried pagination window)
+// doesn't make an ON CONFLICT DO UPDATE upsert affect the same row twice.
+func dedupeCommitsBySHA(repoCommits []*RepoCommit) []*RepoCommit {
+	bySHA := make(map[string]*RepoCommit, len(repoCommits))
+	order := make([]string, 0, len(repoCommits))
+	for _, c := range repoCommits {
+		if _, ok := bySHA[c.SHA]; !ok {
+			order = append(order, c.SHA)
+		}
+		bySHA[c.SHA] = c
+	}
+	deduped := make([]*RepoCommit, len(order))
+	for i, sha := range order {
+		deduped[i] = bySHA[sha]
+	}
+	return deduped
+}
+
+// dedupePRsByRepoIDAndNumber collapses repoPRs down to one entry per
+// (repo_id, pr_number), keeping the last occurrence, for the same reason as
+// dedupeCommitsBySHA: repo_prs' upsert is keyed on (repo_id, pr_number), so
+// a batch with two rows for the same PR would otherwise make the merge
+// below throw "ON CONFLICT DO UPDATE command cannot affect row a second
+// time".
+func dedupePRsByRepoIDAndNumber(repoPRs []*RepoPR) []*RepoPR {
+	type key struct {
+		RepoID int64
+		Number int
+	}
+	byKey := make(map[key]*RepoPR, len(repoPRs))
+	order := make([]key, 0, len(repoPRs))
+	for _, pr := range repoPRs {
+		k := key{pr.RepoID, pr.Number}
+		if _, ok := byKey[k]; !ok {
+			order = append(order, k)
+		}
+		byKey[k] = pr
+	}
+	deduped := make([]*RepoPR, len(order))
+	for i, k := range order {
+		deduped[i] = byKey[k]
+	}
+	return deduped
+}
+
+// highWaterCommit returns the SHA of the most-recently-committed entry in
+// repoCommits for repoID, along with its timestamp.
+func highWaterCommit(repoCommits []*RepoCommit, repoID int64) (sha string, committed time.Time) {
+	for _, c := range repoCommits {
+		if c.RepoID == repoID && c.Committed.After(committed) {
+			sha, committed = c.SHA, c.Committed
+		}
+	}
+	return sha, committed
+}
+
+// highWaterPR returns the number of the most-recently-updated PR in repoPRs
+// for repoID, along with its UpdatedAt. PRs with a nil UpdatedAt are ignored.
+func highWaterPR(repoPRs []*RepoPR, repoID int64) (number string, updatedAt time.Time) {
+	for _, pr := range repoPRs {
+		if pr.RepoID != repoID || pr.UpdatedAt == nil {
+			continue
+		}
+		if pr.UpdatedAt.After(updatedAt) {
+			number, updatedAt = fmt.Sprintf("%d", pr.Number), *pr.UpdatedAt
+		}
+	}
+	return number, updatedAt
+}
+
+// StoreRepoCommits stores repoCommits, upserting on commit_sha. Commits are
+// bulk-loaded into a temporary staging table via COPY, then merged into
+// repo_commits in a single statement, so a batch never hits Postgres's
+// 65535-parameter limit no matter how large it is.
+//
+// StoreRepoCommits manages its own transaction rather than taking a Queryer:
+// the staging table must live on the same connection for the lifetime of
+// the call, which only a transaction guarantees against a pool.
 func (d *DB) StoreRepoCommits(ctx context.Context, repoCommits []*RepoCommit) error {
 	if len(repoCommits) == 0 {
 		return nil // Nothing to store
 	}
 
-	var valueStrings []string
-	var valueArgs []any
-	const fieldCount = 6
-	for i, commit := range repoCommits {
-		valueStrings = append(valueStrings, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)",
-			fieldCount*i+1, fieldCount*i+2, fieldCount*i+3, fieldCount*i+4, fieldCount*i+5, fieldCount*i+6))
-		valueArgs = append(valueArgs, commit.SHA, commit.RepoID, commit.Committed, commit.AuthorEmail,
-			commit.AssociatedPRRepoID, commit.AssociatedPRNumber)
-	}
+	// Deduplicate by SHA (last one wins, the same rule StoreRepos applies to
+	// duplicate org_repo_names): two rows sharing a commit_sha in one batch
+	// (a commit reachable from two branches, overlapping/retried pagination
+	// windows) would otherwise make the merge below throw Postgres's "ON
+	// CONFLICT DO UPDATE command cannot affect row a second time".
+	repoCommits = dedupeCommitsBySHA(repoCommits)
 
-	query := fmt.Sprintf(`
+	err := d.Update(ctx, func(q Queryer) error {
+		tx := q.(pgx.Tx)
+
+		const stagingTable = "repo_commits_staging"
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`
+CREATE TEMPORARY TABLE %s (LIKE repo_commits INCLUDING DEFAULTS) ON COMMIT DROP;`, stagingTable)); err != nil {
+			return fmt.Errorf("StoreRepoCommits: failed to create staging table: %v", err)
+		}
+
+		columns := []string{"commit_sha", "repo_id", "committed_date", "author_email", "associated_pr_repo_id", "associated_pr_number"}
+		rows := make([][]any, len(repoCommits))
+		for i, commit := range repoCommits {
+			rows[i] = []any{commit.SHA, commit.RepoID, commit.Committed, commit.AuthorEmail, commit.AssociatedPRRepoID, commit.AssociatedPRNumber}
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{stagingTable}, columns, pgx.CopyFromRows(rows)); err != nil {
+			return fmt.Errorf("StoreRepoCommits: failed to copy into staging table: %v", err)
+		}
+
+		mergeQuery := fmt.Sprintf(`
 INSERT INTO repo_commits (commit_sha, repo_id, committed_date, author_email, associated_pr_repo_id, associated_pr_number)
-VALUES %s
+SELECT commit_sha, repo_id, committed_date, author_email, associated_pr_repo_id, associated_pr_number FROM %s
 ON CONFLICT (commit_sha) DO UPDATE SET
     repo_id = EXCLUDED.repo_id,
     committed_date = EXCLUDED.committed_date,
     author_email = EXCLUDED.author_email,
     associated_pr_repo_id = EXCLUDED.associated_pr_repo_id,
-    associated_pr_number = EXCLUDED.associated_pr_number;`, strings.Join(valueStrings, ",\n\t"))
+    associated_pr_number = EXCLUDED.associated_pr_number;`, stagingTable)
+		if _, err := tx.Exec(ctx, mergeQuery); err != nil {
+			return fmt.Errorf("StoreRepoCommits:\nquery: %s\nerror: %v", mergeQuery, err)
+		}
 
-	if _, err := d.db.ExecContext(ctx, query, valueArgs...); err != nil {
-		return fmt.Errorf("StoreRepoCommits:\nquery: %s\nerror: %v", query, err)
+		// Advance each affected repo's commit cursor in the same
+		// transaction as the insert, so a crash mid-batch can't leave the
+		// cursor ahead of data that was never committed.
+		seenRepoIDs := make(map[int64]bool)
+		for _, commit := range repoCommits {
+			if seenRepoIDs[commit.RepoID] {
+				continue
+			}
+			seenRepoIDs[commit.RepoID] = true
+
+			sha, committed := highWaterCommit(repoCommits, commit.RepoID)
+			if err := d.AdvanceIndexCursor(ctx, tx, commit.RepoID, IndexCursorKindCommits, committed, sha); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	slog.Info(fmt.Sprintf("stored %d commits in database", len(repoCommits)))
 	return nil
 }
 
+// StoreRepoPRs manages its own transaction rather than taking a Queryer, for
+// the same reason as StoreRepoCommits: its staging tables require a single
+// connection for the lifetime of the call.
 func (d *DB) StoreRepoPRs(ctx context.Context, repoPRs []*RepoPR) error {
 	if len(repoPRs) == 0 {
 		return nil // Nothing to store
 	}
 
-	// Use a transaction to ensure consistency
-	tx, err := d.db.BeginTx(ctx, nil)
-	if err != nil {
-		return fmt.Errorf("StoreRepoPRs: failed to begin transaction: %v", err)
-	}
-	defer tx.Rollback()
+	// Deduplicate by (repo_id, pr_number) (last one wins, the same rule
+	// StoreRepos applies to duplicate org_repo_names): two rows for the same
+	// PR in one batch (overlapping/retried pagination windows) would
+	// otherwise make the merge below throw Postgres's "ON CONFLICT DO
+	// UPDATE command cannot affect row a second time".
+	repoPRs = dedupePRsByRepoIDAndNumber(repoPRs)
+
+	err := d.Update(ctx, func(q Queryer) error {
+		tx := q.(pgx.Tx)
+
+		// Insert PRs first, via a staging table so a batch never hits the
+		// parameter limit.
+		const prStagingTable = "repo_prs_staging"
+		if _, err := tx.Exec(ctx, fmt.Sprintf(`
+CREATE TEMPORARY TABLE %s (LIKE repo_prs INCLUDING DEFAULTS) ON COMMIT DROP;`, prStagingTable)); err != nil {
+			return fmt.Errorf("StoreRepoPRs: failed to create PR staging table: %v", err)
+		}
 
-	// Insert PRs first
-	var prValueStrings []string
-	var prValueArgs []any
-	const prFieldCount = 4
-	for i, pr := range repoPRs {
-		prValueStrings = append(prValueStrings, fmt.Sprintf("($%d, $%d, $%d, $%d)",
-			prFieldCount*i+1, prFieldCount*i+2, prFieldCount*i+3, prFieldCount*i+4))
-		prValueArgs = append(prValueArgs, pr.RepoID, pr.Number, pr.Created, pr.Merged)
-	}
+		prColumns := []string{"repo_id", "pr_number", "created", "merged", "updated_at"}
+		prRows := make([][]any, len(repoPRs))
+		for i, pr := range repoPRs {
+			prRows[i] = []any{pr.RepoID, pr.Number, pr.Created, pr.Merged, pr.UpdatedAt}
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{prStagingTable}, prColumns, pgx.CopyFromRows(prRows)); err != nil {
+			return fmt.Errorf("StoreRepoPRs: failed to copy PRs into staging table: %v", err)
+		}
 
-	prQuery := fmt.Sprintf(`
-INSERT INTO repo_prs (repo_id, pr_number, created, merged)
-VALUES %s
+		prMergeQuery := fmt.Sprintf(`
+INSERT INTO repo_prs (repo_id, pr_number, created, merged, updated_at)
+SELECT repo_id, pr_number, created, merged, updated_at FROM %s
 ON CONFLICT (repo_id, pr_number) DO UPDATE SET
     created = EXCLUDED.created,
-    merged = EXCLUDED.merged;`, strings.Join(prValueStrings, ",\n\t"))
-
-	if _, err := tx.ExecContext(ctx, prQuery, prValueArgs...); err != nil {
-		return fmt.Errorf("StoreRepoPRs PRs:\nquery: %s\nerror: %v", prQuery, err)
-	}
-
-	// Delete existing reviewers for these PRs to avoid stale data
-	for _, pr := range repoPRs {
-		deleteQuery := `DELETE FROM pr_reviewers WHERE repo_id = $1 AND pr_number = $2`
-		if _, err := tx.ExecContext(ctx, deleteQuery, pr.RepoID, pr.Number); err != nil {
-			return fmt.Errorf("StoreRepoPRs delete existing reviewers for PR %d: %v", pr.Number, err)
+    merged = EXCLUDED.merged,
+    updated_at = EXCLUDED.updated_at;`, prStagingTable)
+		if _, err := tx.Exec(ctx, prMergeQuery); err != nil {
+			return fmt.Errorf("StoreRepoPRs PRs:\nquery: %s\nerror: %v", prMergeQuery, err)
 		}
-	}
 
-	// Insert reviewers
-	var allReviewers []*struct {
-		RepoID        int64
-		PRNumber      int
-		ReviewerEmail string
-		NumComments   int
-		Approved      bool
-	}
+		// Advance each affected repo's PR cursor in the same transaction as
+		// the insert, so a crash mid-batch can't leave the cursor ahead of
+		// data that was never committed.
+		seenRepoIDs := make(map[int64]bool)
+		for _, pr := range repoPRs {
+			if seenRepoIDs[pr.RepoID] {
+				continue
+			}
+			seenRepoIDs[pr.RepoID] = true
+
+			number, updatedAt := highWaterPR(repoPRs, pr.RepoID)
+			if number == "" {
+				continue // None of this repo's PRs in the batch carried an UpdatedAt.
+			}
+			if err := d.AdvanceIndexCursor(ctx, tx, pr.RepoID, IndexCursorKindPRs, updatedAt, number); err != nil {
+				return err
+			}
+		}
 
-	for _, pr := range repoPRs {
-		for _, reviewer := range pr.Reviewers {
-			allReviewers = append(allReviewers, &struct {
-				RepoID        int64
-				PRNumber      int
-				ReviewerEmail string
-				NumComments   int
-				Approved      bool
-			}{
-				RepoID:        pr.RepoID,
-				PRNumber:      pr.Number,
-				ReviewerEmail: reviewer.ReviewerEmail,
-				NumComments:   reviewer.NumComments,
-				Approved:      reviewer.Approved,
-			})
+		// Delete existing reviewers for these PRs to avoid stale data
+		for _, pr := range repoPRs {
+			deleteQuery := `DELETE FROM pr_reviewers WHERE repo_id = $1 AND pr_number = $2`
+			if _, err := tx.Exec(ctx, deleteQuery, pr.RepoID, pr.Number); err != nil {
+				return fmt.Errorf("StoreRepoPRs delete existing reviewers for PR %d: %v", pr.Number, err)
+			}
 		}
-	}
 
-	if len(allReviewers) > 0 {
-		var reviewerValueStrings []string
-		var reviewerValueArgs []any
-		const reviewerFieldCount = 5
-		for i, reviewer := range allReviewers {
-			reviewerValueStrings = append(reviewerValueStrings, fmt.Sprintf("($%d, $%d, $%d, $%d, $%d)",
-				reviewerFieldCount*i+1, reviewerFieldCount*i+2, reviewerFieldCount*i+3, reviewerFieldCount*i+4, reviewerFieldCount*i+5))
-			reviewerValueArgs = append(reviewerValueArgs, reviewer.RepoID, reviewer.PRNumber, reviewer.ReviewerEmail,
-				reviewer.NumComments, reviewer.Approved)
+		// Insert reviewers, also via a staging table.
+		type reviewerRow struct {
+			RepoID        int64
+			PRNumber      int
+			ReviewerEmail string
+			NumComments   int
+			Approved      bool
+		}
+		var allReviewers []*reviewerRow
+		for _, pr := range repoPRs {
+			for _, reviewer := range pr.Reviewers {
+				allReviewers = append(allReviewers, &reviewerRow{
+					RepoID:        pr.RepoID,
+					PRNumber:      pr.Number,
+					ReviewerEmail: reviewer.ReviewerEmail,
+					NumComments:   reviewer.NumComments,
+					Approved:      reviewer.Approved,
+				})
+			}
 		}
 
-		reviewerQuery := fmt.Sprintf(`
+		if len(allReviewers) > 0 {
+			const reviewerStagingTable = "pr_reviewers_staging"
+			if _, err := tx.Exec(ctx, fmt.Sprintf(`
+CREATE TEMPORARY TABLE %s (LIKE pr_reviewers INCLUDING DEFAULTS) ON COMMIT DROP;`, reviewerStagingTable)); err != nil {
+				return fmt.Errorf("StoreRepoPRs: failed to create reviewer staging table: %v", err)
+			}
+
+			reviewerColumns := []string{"repo_id", "pr_number", "reviewer_email", "num_comments", "approved"}
+			reviewerRows := make([][]any, len(allReviewers))
+			for i, reviewer := range allReviewers {
+				reviewerRows[i] = []any{reviewer.RepoID, reviewer.PRNumber, reviewer.ReviewerEmail, reviewer.NumComments, reviewer.Approved}
+			}
+			if _, err := tx.CopyFrom(ctx, pgx.Identifier{reviewerStagingTable}, reviewerColumns, pgx.CopyFromRows(reviewerRows)); err != nil {
+				return fmt.Errorf("StoreRepoPRs: failed to copy reviewers into staging table: %v", err)
+			}
+
+			reviewerMergeQuery := fmt.Sprintf(`
 INSERT INTO pr_reviewers (repo_id, pr_number, reviewer_email, num_comments, approved)
-VALUES %s;`, strings.Join(reviewerValueStrings, ",\n\t"))
-
-		if _, err := tx.ExecContext(ctx, reviewerQuery, reviewerValueArgs...); err != nil {
-			return fmt.Errorf("StoreRepoPRs reviewers:\nquery: %s\nerror: %v", reviewerQuery, err)
+SELECT repo_id, pr_number, reviewer_email, num_comments, approved FROM %s;`, reviewerStagingTable)
+			if _, err := tx.Exec(ctx, reviewerMergeQuery); err != nil {
+				return fmt.Errorf("StoreRepoPRs reviewers:\nquery: %s\nerror: %v", reviewerMergeQuery, err)
+			}
 		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("StoreRepoPRs: failed to commit transaction: %v", err)
+		return nil
+	})
+	if err != nil {
+		return err
 	}
 
 	totalReviewers := 0
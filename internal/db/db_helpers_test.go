@@ -1,7 +1,6 @@
 package db_test
 
 import (
-	"database/sql"
 	"fmt"
 	"os"
 	"strconv"
@@ -10,40 +9,66 @@ import (
 
 	"github.com/golang-migrate/migrate/v4"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/jeanbza/codereviewdash/internal/db"
 
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 )
 
-func postgresDetails() (username string, password string, host string, port uint16, dbname string, _ error) {
+// dbDetails reads connection details for the backend under test, selected
+// via TEST_DB_KIND (one of "postgres" (the default), "mysql", or "sqlite").
+// Only Postgres has a working Queryer today (see the TODO on db.DB), so
+// anything else is reported as an error rather than silently falling back.
+func dbDetails() (dialect db.Dialect, username, password, host string, port uint16, dbname string, _ error) {
+	kind := os.Getenv("TEST_DB_KIND")
+	if kind == "" {
+		kind = "postgres"
+	}
+	switch kind {
+	case "postgres":
+		dialect = db.DialectPostgres
+	case "mysql":
+		dialect = db.DialectMySQL
+	case "sqlite":
+		dialect = db.DialectSQLite
+	default:
+		return 0, "", "", "", 0, "", fmt.Errorf("dbDetails: TEST_DB_KIND=%q must be one of postgres, mysql, sqlite", kind)
+	}
+	if !dialect.IsPostgres() {
+		return 0, "", "", "", 0, "", fmt.Errorf("dbDetails: TEST_DB_KIND=%q is not yet wired up; only postgres has a working Queryer today", kind)
+	}
+
 	username = os.Getenv("POSTGRES_USERNAME")
 	if username == "" {
-		return "", "", "", 0, "", fmt.Errorf("POSTGRES_USERNAME is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
+		return 0, "", "", "", 0, "", fmt.Errorf("POSTGRES_USERNAME is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
 	}
 	password = os.Getenv("POSTGRES_PASSWORD")
 	// Note: password can be empty (e.g., macOS Homebrew PostgreSQL doesn't require a password)
 	host = os.Getenv("POSTGRES_HOST")
 	if host == "" {
-		return "", "", "", 0, "", fmt.Errorf("POSTGRES_HOST is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
+		return 0, "", "", "", 0, "", fmt.Errorf("POSTGRES_HOST is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
 	}
 	portStr := os.Getenv("POSTGRES_PORT")
 	if portStr == "" {
-		return "", "", "", 0, "", fmt.Errorf("POSTGRES_PORT is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
+		return 0, "", "", "", 0, "", fmt.Errorf("POSTGRES_PORT is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
 	}
 	portUint64, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
-		return "", "", "", 0, "", fmt.Errorf("POSTGRES_PORT is invalid: %v", err)
+		return 0, "", "", "", 0, "", fmt.Errorf("POSTGRES_PORT is invalid: %v", err)
 	}
 	dbname = os.Getenv("POSTGRES_DB")
 	if dbname == "" {
-		return "", "", "", 0, "", fmt.Errorf("POSTGRES_DB is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
+		return 0, "", "", "", 0, "", fmt.Errorf("POSTGRES_DB is not set. Must set POSTGRES_USERNAME, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB (POSTGRES_PASSWORD is optional)")
 	}
 
-	return username, password, host, uint16(portUint64), dbname, nil
+	return dialect, username, password, host, uint16(portUint64), dbname, nil
 }
 
-// Drops tables and re-runs migrations.
-func resetTables(t *testing.T, db *sql.DB) {
-	if _, err := db.ExecContext(t.Context(), `
+// Drops tables and re-runs migrations for dialect.
+func resetTables(t *testing.T, dialect db.Dialect, pool *pgxpool.Pool) {
+	if _, err := pool.Exec(t.Context(), `
+		DROP TABLE IF EXISTS repo_indexing_cursor;
 		DROP TABLE IF EXISTS pr_reviewers;
 		DROP TABLE IF EXISTS repo_commits;
 		DROP TABLE IF EXISTS repo_prs;
@@ -58,11 +83,12 @@ func resetTables(t *testing.T, db *sql.DB) {
 		t.Fatalf("resetTables: error dropping repo_tags table: %v", err)
 	}
 
-	driver, err := postgres.WithInstance(db, &postgres.Config{})
+	sqlDB := db.OpenDBFromPool(pool)
+	driver, err := postgres.WithInstance(sqlDB, &postgres.Config{})
 	if err != nil {
 		t.Fatalf("resetTables: error creating postgres driver: %v", err)
 	}
-	m, err := migrate.NewWithDatabaseInstance("file://../../migrations", "postgres", driver)
+	m, err := migrate.NewWithDatabaseInstance(fmt.Sprintf("file://../../migrations/%s", dialect), "postgres", driver)
 	if err != nil {
 		t.Fatalf("resetTables: error creating database migrator: %v", err)
 	}
@@ -71,7 +97,7 @@ func resetTables(t *testing.T, db *sql.DB) {
 	}
 }
 
-func setAllReposIndexing(t *testing.T, db *sql.DB, indexingBegan, indexingFinished time.Time) {
+func setAllReposIndexing(t *testing.T, pool *pgxpool.Pool, indexingBegan, indexingFinished time.Time) {
 	t.Helper()
 
 	query := fmt.Sprintf(`
@@ -79,7 +105,7 @@ UPDATE repo_indexing
 SET indexing_began = TIMESTAMP WITH TIME ZONE '%s', indexing_finished = TIMESTAMP WITH TIME ZONE '%s'`,
 		indexingBegan.Format(time.RFC3339), indexingFinished.Format(time.RFC3339))
 
-	if _, err := db.ExecContext(t.Context(), query); err != nil {
+	if _, err := pool.Exec(t.Context(), query); err != nil {
 		t.Fatalf("setAllReposIndexing: error updating repo_indexing table:\nquery: %s\nerror: %v", query, err)
 	}
 }
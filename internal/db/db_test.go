@@ -1,110 +1,535 @@
 package db_test
 
 import (
-	"database/sql"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
-	"github.com/jeanbza/codereviewdash/internal/db"
+	"github.com/jackc/pgx/v5/pgxpool"
 
-	_ "github.com/lib/pq" // Postgres driver
+	"github.com/jeanbza/codereviewdash/internal/db"
 )
 
+// fakeClock is a db.Clock that always returns a fixed instant, so reindex
+// tests can place indexing_began/indexing_finished at exact offsets from
+// "now" instead of racing wall-clock time.
+type fakeClock struct {
+	now time.Time
+}
+
+func (f fakeClock) Now() time.Time { return f.now }
+
 type reindexWorkerTestCase struct {
-	name                 string
-	lastIndexingBegan    time.Time
-	lastIndexingFinished time.Time
-	reindexTTL           time.Duration
-	reindexPeriod        time.Duration // We should reindex after this period of time.
-	expectReindex        bool
+	name                   string
+	indexingBeganOffset    time.Duration // Relative to the fake clock's "now".
+	indexingFinishedOffset time.Duration // Relative to the fake clock's "now".
+	reindexTTL             time.Duration
+	reindexPeriod          time.Duration // We should reindex after this period of time.
+	expectReindex          bool
 }
 
 var reindexWorkerTestCases = []*reindexWorkerTestCase{
 	{
 		// We re-indexed long ago: we should do so again.
-		name:                 "beyond reindex period",
-		lastIndexingBegan:    time.Now().Add(-24 * time.Hour),
-		lastIndexingFinished: time.Now().Add(-24 * time.Hour),
-		reindexTTL:           time.Minute,
-		reindexPeriod:        time.Hour,
-		expectReindex:        true,
+		name:                   "beyond reindex period",
+		indexingBeganOffset:    -24 * time.Hour,
+		indexingFinishedOffset: -24 * time.Hour,
+		reindexTTL:             time.Minute,
+		reindexPeriod:          time.Hour,
+		expectReindex:          true,
 	},
 	{
 		// We re-indexed long ago, but another worker is busy re-indexing: don't re-index.
-		name:                 "beyond reindex period but another worker busy",
-		lastIndexingBegan:    time.Now().Add(-1 * time.Minute), // The other worker only started 1m ago, and has 5m: give it more time.
-		lastIndexingFinished: time.Now().Add(-24 * time.Hour),
-		reindexTTL:           5 * time.Minute,
-		reindexPeriod:        time.Hour,
-		expectReindex:        false,
+		name:                   "beyond reindex period but another worker busy",
+		indexingBeganOffset:    -1 * time.Minute, // The other worker only started 1m ago, and has 5m: give it more time.
+		indexingFinishedOffset: -24 * time.Hour,
+		reindexTTL:             5 * time.Minute,
+		reindexPeriod:          time.Hour,
+		expectReindex:          false,
 	},
 	{
 		// We re-indexed long ago, but another worker is busy re-indexing: don't re-index.
-		name:                 "beyond reindex period and another worker stalled",
-		lastIndexingBegan:    time.Now().Add(-6 * time.Minute), // The other worker only started 6m ago, and has 5m: it's stalled, so take over.
-		lastIndexingFinished: time.Now().Add(-24 * time.Hour),
-		reindexTTL:           5 * time.Minute,
-		reindexPeriod:        time.Hour,
-		expectReindex:        true,
+		name:                   "beyond reindex period and another worker stalled",
+		indexingBeganOffset:    -6 * time.Minute, // The other worker only started 6m ago, and has 5m: it's stalled, so take over.
+		indexingFinishedOffset: -24 * time.Hour,
+		reindexTTL:             5 * time.Minute,
+		reindexPeriod:          time.Hour,
+		expectReindex:          true,
 	},
 	{
 		// We've re-indexed recently: no point doing so again.
-		name:                 "within reindex period",
-		lastIndexingBegan:    time.Now().Add(-10 * time.Minute),
-		lastIndexingFinished: time.Now().Add(-10 * time.Minute),
-		reindexTTL:           time.Minute,
-		reindexPeriod:        time.Hour,
-		expectReindex:        false,
+		name:                   "within reindex period",
+		indexingBeganOffset:    -10 * time.Minute,
+		indexingFinishedOffset: -10 * time.Minute,
+		reindexTTL:             time.Minute,
+		reindexPeriod:          time.Hour,
+		expectReindex:          false,
 	},
 	{
 		// We're beyond the re-indexing TTL. But, since we're still within the re-indexing period, no need to re-index.
-		name:                 "within reindex period despite recent start",
-		lastIndexingBegan:    time.Now().Add(-10 * time.Minute),
-		lastIndexingFinished: time.Now().Add(-10 * time.Minute),
-		reindexTTL:           time.Second, // The last re-indexing worker had 1s to finish, and it's far beyond that TTL.
-		reindexPeriod:        time.Hour,
-		expectReindex:        false,
+		name:                   "within reindex period despite recent start",
+		indexingBeganOffset:    -10 * time.Minute,
+		indexingFinishedOffset: -10 * time.Minute,
+		reindexTTL:             time.Second, // The last re-indexing worker had 1s to finish, and it's far beyond that TTL.
+		reindexPeriod:          time.Hour,
+		expectReindex:          false,
 	},
 }
 
 func TestNextReindexAllReposWork_Basic(t *testing.T) {
-	sutDB, sqlDB := setupDB(t)
+	_, pool := setupDB(t)
 
 	for _, tc := range reindexWorkerTestCases {
 		t.Run(tc.name, func(t *testing.T) {
-			resetTables(t, sqlDB)
-			setAllReposIndexing(t, sqlDB, time.Now().Add(-24*time.Hour), time.Now().Add(-24*time.Hour))
-			shouldReindex, err := sutDB.NextReindexAllReposWork(t.Context(), 5*time.Minute, 24*time.Hour)
+			resetTables(t, db.DialectPostgres, pool)
+
+			clock := fakeClock{now: time.Now()}
+			setAllReposIndexing(t, pool, clock.now.Add(tc.indexingBeganOffset), clock.now.Add(tc.indexingFinishedOffset))
+
+			sutDB := db.NewDBWithClock(pool, clock)
+			var shouldReindex bool
+			err := sutDB.Update(t.Context(), func(q db.Queryer) error {
+				var err error
+				shouldReindex, err = sutDB.NextReindexAllReposWork(t.Context(), q, "worker-1", tc.reindexTTL, tc.reindexPeriod)
+				return err
+			})
 			if err != nil {
 				t.Fatal(err)
 			}
-			if got, want := shouldReindex, true; got != want {
+			if got, want := shouldReindex, tc.expectReindex; got != want {
 				t.Errorf("expected shouldReindex=%v, got %v", want, got)
 			}
 		})
 	}
 }
 
-func setupDB(t *testing.T) (*db.DB, *sql.DB) {
+func TestNextReindexAllReposWork_RecordsWorkerIdentity(t *testing.T) {
+	_, pool := setupDB(t)
+
+	clock := fakeClock{now: time.Now()}
+	setAllReposIndexing(t, pool, clock.now.Add(-24*time.Hour), clock.now.Add(-24*time.Hour))
+
+	sutDB := db.NewDBWithClock(pool, clock)
+	err := sutDB.Update(t.Context(), func(q db.Queryer) error {
+		shouldReindex, err := sutDB.NextReindexAllReposWork(t.Context(), q, "worker-42", time.Minute, time.Hour)
+		if err != nil {
+			return err
+		}
+		if !shouldReindex {
+			t.Fatal("expected shouldReindex=true")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var workerID string
+	var attempts int
+	if err := pool.QueryRow(t.Context(), `SELECT indexing_worker_id, indexing_attempts FROM repo_indexing`).Scan(&workerID, &attempts); err != nil {
+		t.Fatalf("querying repo_indexing: %v", err)
+	}
+	if got, want := workerID, "worker-42"; got != want {
+		t.Errorf("indexing_worker_id = %q, want %q", got, want)
+	}
+	if got, want := attempts, 1; got != want {
+		t.Errorf("indexing_attempts = %d, want %d", got, want)
+	}
+}
+
+func TestListStalledIndexingJobs(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	clock := fakeClock{now: time.Now()}
+	clockedDB := db.NewDBWithClock(pool, clock)
+
+	// Claim the repo's lease but never mark it finished, simulating a
+	// worker that crashed mid-index.
+	err := clockedDB.Update(t.Context(), func(q db.Queryer) error {
+		_, _, _, found, err := clockedDB.NextReindexRepoWork(t.Context(), q, "worker-stalled", time.Minute, time.Hour)
+		if err != nil {
+			return err
+		}
+		if !found {
+			t.Fatal("expected work to be found")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	jobs, err := clockedDB.ListStalledIndexingJobs(t.Context(), pool, -time.Second)
+	if err != nil {
+		t.Fatalf("ListStalledIndexingJobs: %v", err)
+	}
+	if got, want := len(jobs), 1; got != want {
+		t.Fatalf("len(jobs) = %d, want %d", got, want)
+	}
+	if got, want := jobs[0].RepoID, repoID; got != want {
+		t.Errorf("RepoID = %d, want %d", got, want)
+	}
+	if got, want := jobs[0].WorkerID, "worker-stalled"; got != want {
+		t.Errorf("WorkerID = %q, want %q", got, want)
+	}
+	if got, want := jobs[0].Attempts, 1; got != want {
+		t.Errorf("Attempts = %d, want %d", got, want)
+	}
+}
+
+func TestStoreRepos_DuplicateOrgRepoNameInBatch(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	// The same org_repo_name appearing twice in one batch used to fail the
+	// unnest-based upsert with "ON CONFLICT DO UPDATE command cannot affect
+	// row a second time"; it should instead behave like the old per-row
+	// loop, where the last entry for a given name wins.
+	repos := []*db.Repo{
+		{OrgRepoName: "acme/widgets", DefaultBranchName: "main"},
+		{OrgRepoName: "acme/widgets", DefaultBranchName: "develop"},
+	}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	if repos[0].RepoID != repos[1].RepoID {
+		t.Errorf("RepoID mismatch for duplicate org_repo_name: %d != %d", repos[0].RepoID, repos[1].RepoID)
+	}
+
+	var defaultBranchName string
+	if err := pool.QueryRow(t.Context(), `SELECT default_branch_name FROM repos WHERE org_repo_name = $1`, "acme/widgets").Scan(&defaultBranchName); err != nil {
+		t.Fatalf("querying repos: %v", err)
+	}
+	if got, want := defaultBranchName, "develop"; got != want {
+		t.Errorf("default_branch_name = %q, want %q (last entry should win)", got, want)
+	}
+}
+
+func TestStoreRepoCommits_DuplicateSHAInBatch(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	// The same commit_sha appearing twice in one batch (a commit reachable
+	// from two branches, an overlapping/retried pagination window) used to
+	// fail the COPY-then-merge upsert with "ON CONFLICT DO UPDATE command
+	// cannot affect row a second time"; it should instead behave like
+	// StoreRepos, where the last entry for a given key wins.
+	sha := strings.Repeat("a", 40)
+	commits := []*db.RepoCommit{
+		{SHA: sha, RepoID: repoID, Committed: time.Now().Add(-time.Hour), AuthorEmail: "old@example.com"},
+		{SHA: sha, RepoID: repoID, Committed: time.Now(), AuthorEmail: "new@example.com"},
+	}
+	if err := sutDB.StoreRepoCommits(t.Context(), commits); err != nil {
+		t.Fatalf("StoreRepoCommits: %v", err)
+	}
+
+	var authorEmail string
+	if err := pool.QueryRow(t.Context(), `SELECT author_email FROM repo_commits WHERE commit_sha = $1`, sha).Scan(&authorEmail); err != nil {
+		t.Fatalf("querying repo_commits: %v", err)
+	}
+	if got, want := authorEmail, "new@example.com"; got != want {
+		t.Errorf("author_email = %q, want %q (last entry should win)", got, want)
+	}
+}
+
+func TestStoreRepoPRs_DuplicatePRInBatch(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	// The same (repo_id, pr_number) appearing twice in one batch (an
+	// overlapping/retried pagination window) used to fail the
+	// COPY-then-merge upsert the same way StoreRepoCommits did; the last
+	// entry for a given key should win.
+	oldMerged := time.Now().Add(-time.Hour)
+	newMerged := time.Now()
+	prs := []*db.RepoPR{
+		{RepoID: repoID, Number: 1, Merged: &oldMerged},
+		{RepoID: repoID, Number: 1, Merged: &newMerged},
+	}
+	if err := sutDB.StoreRepoPRs(t.Context(), prs); err != nil {
+		t.Fatalf("StoreRepoPRs: %v", err)
+	}
+
+	var gotMerged time.Time
+	if err := pool.QueryRow(t.Context(), `SELECT merged FROM repo_prs WHERE repo_id = $1 AND pr_number = $2`, repoID, 1).Scan(&gotMerged); err != nil {
+		t.Fatalf("querying repo_prs: %v", err)
+	}
+	if !gotMerged.Equal(newMerged.Truncate(time.Microsecond)) {
+		t.Errorf("merged = %v, want %v (last entry should win)", gotMerged, newMerged)
+	}
+}
+
+func TestStoreRepoCommits_BeyondParameterLimit(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	// 100k commits at 6 fields each would be 600k bind parameters, well past
+	// Postgres's 65535 limit for a single VALUES-list INSERT. COPY has no
+	// such limit.
+	const numCommits = 100_000
+	commits := make([]*db.RepoCommit, numCommits)
+	for i := range commits {
+		commits[i] = &db.RepoCommit{
+			SHA:         fmt.Sprintf("%040d", i),
+			RepoID:      repoID,
+			Committed:   time.Now().Add(-time.Duration(i) * time.Second),
+			AuthorEmail: fmt.Sprintf("author%d@example.com", i%50),
+		}
+	}
+
+	if err := sutDB.StoreRepoCommits(t.Context(), commits); err != nil {
+		t.Fatalf("StoreRepoCommits: %v", err)
+	}
+}
+
+func TestStoreRepoCommits_AdvancesIndexCursor(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	newest := time.Now()
+	commits := []*db.RepoCommit{
+		{SHA: strings.Repeat("a", 40), RepoID: repoID, Committed: newest.Add(-time.Hour), AuthorEmail: "a@example.com"},
+		{SHA: strings.Repeat("b", 40), RepoID: repoID, Committed: newest, AuthorEmail: "b@example.com"},
+	}
+	if err := sutDB.StoreRepoCommits(t.Context(), commits); err != nil {
+		t.Fatalf("StoreRepoCommits: %v", err)
+	}
+
+	var sinceTime time.Time
+	var sinceSHA string
+	err := sutDB.View(t.Context(), func(q db.Queryer) error {
+		var err error
+		sinceTime, sinceSHA, err = sutDB.GetIndexCursor(t.Context(), q, repoID, db.IndexCursorKindCommits)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetIndexCursor: %v", err)
+	}
+	if got, want := sinceSHA, strings.Repeat("b", 40); got != want {
+		t.Errorf("GetIndexCursor sinceSHA = %q, want %q", got, want)
+	}
+	if !sinceTime.Equal(newest.Truncate(time.Microsecond)) {
+		t.Errorf("GetIndexCursor sinceTime = %v, want %v", sinceTime, newest)
+	}
+}
+
+func TestStoreRepoPRs_WithReviewers(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	created := time.Now().Add(-24 * time.Hour)
+	merged := time.Now()
+	updatedAt := time.Now()
+	prs := []*db.RepoPR{
+		{
+			RepoID:    repoID,
+			Number:    1,
+			Created:   &created,
+			Merged:    &merged,
+			UpdatedAt: &updatedAt,
+			Reviewers: []*db.RepoPRReviewerStats{
+				{ReviewerEmail: "alice@example.com", NumComments: 3, Approved: true},
+				{ReviewerEmail: "bob@example.com", NumComments: 0, Approved: false},
+			},
+		},
+	}
+	if err := sutDB.StoreRepoPRs(t.Context(), prs); err != nil {
+		t.Fatalf("StoreRepoPRs: %v", err)
+	}
+
+	var gotMerged time.Time
+	if err := pool.QueryRow(t.Context(), `SELECT merged FROM repo_prs WHERE repo_id = $1 AND pr_number = $2`, repoID, 1).Scan(&gotMerged); err != nil {
+		t.Fatalf("querying repo_prs: %v", err)
+	}
+	if !gotMerged.Equal(merged.Truncate(time.Microsecond)) {
+		t.Errorf("merged = %v, want %v", gotMerged, merged)
+	}
+
+	rows, err := pool.Query(t.Context(), `
+SELECT reviewer_email, num_comments, approved
+FROM pr_reviewers
+WHERE repo_id = $1 AND pr_number = $2
+ORDER BY reviewer_email;`, repoID, 1)
+	if err != nil {
+		t.Fatalf("querying pr_reviewers: %v", err)
+	}
+	defer rows.Close()
+
+	type reviewer struct {
+		Email       string
+		NumComments int
+		Approved    bool
+	}
+	var gotReviewers []reviewer
+	for rows.Next() {
+		var r reviewer
+		if err := rows.Scan(&r.Email, &r.NumComments, &r.Approved); err != nil {
+			t.Fatalf("scanning pr_reviewers row: %v", err)
+		}
+		gotReviewers = append(gotReviewers, r)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatalf("iterating pr_reviewers: %v", err)
+	}
+	wantReviewers := []reviewer{
+		{Email: "alice@example.com", NumComments: 3, Approved: true},
+		{Email: "bob@example.com", NumComments: 0, Approved: false},
+	}
+	if len(gotReviewers) != len(wantReviewers) {
+		t.Fatalf("len(reviewers) = %d, want %d", len(gotReviewers), len(wantReviewers))
+	}
+	for i := range wantReviewers {
+		if gotReviewers[i] != wantReviewers[i] {
+			t.Errorf("reviewer[%d] = %+v, want %+v", i, gotReviewers[i], wantReviewers[i])
+		}
+	}
+
+	var sinceNumber string
+	err = sutDB.View(t.Context(), func(q db.Queryer) error {
+		var err error
+		_, sinceNumber, err = sutDB.GetIndexCursor(t.Context(), q, repoID, db.IndexCursorKindPRs)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetIndexCursor: %v", err)
+	}
+	if got, want := sinceNumber, "1"; got != want {
+		t.Errorf("GetIndexCursor sinceIDOrNumber = %q, want %q", got, want)
+	}
+}
+
+func TestStoreRepoCommits_DoesNotRewindIndexCursor(t *testing.T) {
+	sutDB, pool := setupDB(t)
+
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(t.Context(), pool, repos); err != nil {
+		t.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	newest := time.Now()
+	if err := sutDB.StoreRepoCommits(t.Context(), []*db.RepoCommit{
+		{SHA: strings.Repeat("a", 40), RepoID: repoID, Committed: newest, AuthorEmail: "a@example.com"},
+	}); err != nil {
+		t.Fatalf("StoreRepoCommits: %v", err)
+	}
+
+	// A later batch that only backfills older history (e.g. a retried or
+	// out-of-order page) must not rewind the cursor behind what's already
+	// been recorded.
+	if err := sutDB.StoreRepoCommits(t.Context(), []*db.RepoCommit{
+		{SHA: strings.Repeat("b", 40), RepoID: repoID, Committed: newest.Add(-time.Hour), AuthorEmail: "b@example.com"},
+	}); err != nil {
+		t.Fatalf("StoreRepoCommits: %v", err)
+	}
+
+	var sinceSHA string
+	err := sutDB.View(t.Context(), func(q db.Queryer) error {
+		var err error
+		_, sinceSHA, err = sutDB.GetIndexCursor(t.Context(), q, repoID, db.IndexCursorKindCommits)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("GetIndexCursor: %v", err)
+	}
+	if got, want := sinceSHA, strings.Repeat("a", 40); got != want {
+		t.Errorf("GetIndexCursor sinceSHA = %q, want %q; cursor rewound", got, want)
+	}
+}
+
+func BenchmarkStoreRepoCommits(b *testing.B) {
+	if os.Getenv("POSTGRES_USERNAME") == "" {
+		b.Skip("skipping database benchmark: POSTGRES_USERNAME not set.")
+	}
+
+	_, username, password, host, port, dbname, err := dbDetails()
+	if err != nil {
+		b.Fatalf("failed to get db details: %v", err)
+	}
+	pool, err := db.Connect(b.Context(), username, password, host, port, dbname)
+	if err != nil {
+		b.Fatalf("failed to connect to db: %v", err)
+	}
+	defer pool.Close()
+
+	sutDB := db.NewDB(pool)
+	repos := []*db.Repo{{OrgRepoName: "acme/widgets", DefaultBranchName: "main"}}
+	if err := sutDB.StoreRepos(b.Context(), pool, repos); err != nil {
+		b.Fatalf("StoreRepos: %v", err)
+	}
+	repoID := repos[0].RepoID
+
+	const commitsPerBatch = 10_000
+	commits := make([]*db.RepoCommit, commitsPerBatch)
+	for i := range commits {
+		commits[i] = &db.RepoCommit{
+			SHA:         fmt.Sprintf("%d-%040d", b.N, i),
+			RepoID:      repoID,
+			Committed:   time.Now(),
+			AuthorEmail: fmt.Sprintf("author%d@example.com", i%50),
+		}
+	}
+
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		if err := sutDB.StoreRepoCommits(b.Context(), commits); err != nil {
+			b.Fatalf("StoreRepoCommits: %v", err)
+		}
+	}
+}
+
+func setupDB(t *testing.T) (*db.DB, *pgxpool.Pool) {
 	// Check if required environment variables are set
 	if os.Getenv("POSTGRES_USERNAME") == "" {
 		t.Skip("skipping database tests: POSTGRES_USERNAME not set. Set POSTGRES_USERNAME, POSTGRES_PASSWORD, POSTGRES_HOST, POSTGRES_PORT, and POSTGRES_DB environment variables to run database tests.")
 	}
 
-	username, password, host, port, dbname, err := postgresDetails()
+	dialect, username, password, host, port, dbname, err := dbDetails()
 	if err != nil {
-		t.Fatalf("failed to get postgres details: %v", err)
+		t.Fatalf("failed to get db details: %v", err)
 	}
 
-	sqlDB, err := db.Connect(t.Context(), username, password, host, port, dbname)
+	pool, err := db.Connect(t.Context(), username, password, host, port, dbname)
 	if err != nil {
 		t.Fatalf("failed to connect to db: %v", err)
 	}
+	t.Cleanup(pool.Close)
 
-	sutDB := db.NewDB(sqlDB)
+	sutDB := db.NewDB(pool)
 
-	resetTables(t, sqlDB)
+	resetTables(t, dialect, pool)
 
-	return sutDB, sqlDB
+	return sutDB, pool
 }
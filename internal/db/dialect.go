@@ -0,0 +1,83 @@
+package db
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dialect identifies which SQL backend a query is being built for. The
+// package started out Postgres-only (hardcoded "postgres://" DSNs,
+// TIMESTAMP WITH TIME ZONE, ON CONFLICT, RETURNING); Dialect lets query
+// string-building branch per backend instead of assuming Postgres
+// everywhere.
+//
+// STATUS: MySQL and SQLite are NOT supported today. This is query-building
+// groundwork only, not a working multi-backend DB: DB.pool is a
+// *pgxpool.Pool (Postgres-only), Connect only ever builds postgres://
+// DSNs, and every method emits Postgres-specific SQL: StoreRepos takes its
+// placeholders and upsert suffix from Dialect but still uses unnest,
+// ::text[] casts and RETURNING, and every other method hardcodes
+// Postgres placeholders, RETURNING, and pgx's CopyFrom. The migrations/mysql and
+// migrations/sqlite trees are never executed by any test, and there is no
+// CI running against either backend. Wiring up MySQL/SQLite for real
+// requires giving DB a database/sql-backed Queryer for those dialects,
+// which hasn't happened yet (see the TODO on DB).
+type Dialect int
+
+const (
+	DialectPostgres Dialect = iota
+	DialectMySQL
+	DialectSQLite
+)
+
+func (d Dialect) String() string {
+	switch d {
+	case DialectPostgres:
+		return "postgres"
+	case DialectMySQL:
+		return "mysql"
+	case DialectSQLite:
+		return "sqlite"
+	default:
+		return fmt.Sprintf("Dialect(%d)", int(d))
+	}
+}
+
+// IsPostgres reports whether d is DialectPostgres. It's the only dialect
+// with a working Queryer today (see the Dialect doc comment); callers like
+// dbDetails use it to reject the others explicitly instead of silently
+// behaving as if they worked.
+func (d Dialect) IsPostgres() bool { return d == DialectPostgres }
+
+// placeholder renders the i'th (1-indexed) bind parameter in this dialect's
+// syntax: Postgres uses "$i"; MySQL and SQLite use a plain "?".
+func (d Dialect) placeholder(i int) string {
+	if d == DialectPostgres {
+		return fmt.Sprintf("$%d", i)
+	}
+	return "?"
+}
+
+// upsertSuffix returns the fragment for upserting into a table on
+// conflictCol: "ON CONFLICT ... DO UPDATE SET" for Postgres and SQLite, and
+// "ON DUPLICATE KEY UPDATE" for MySQL, setting each of setCols to the value
+// of the row that would have conflicted.
+func (d Dialect) upsertSuffix(conflictCol string, setCols []string) string {
+	switch d {
+	case DialectPostgres, DialectSQLite:
+		// SQLite's UPSERT syntax (3.24+) mirrors Postgres's.
+		sets := make([]string, len(setCols))
+		for i, c := range setCols {
+			sets[i] = fmt.Sprintf("%s = EXCLUDED.%s", c, c)
+		}
+		return fmt.Sprintf("ON CONFLICT (%s) DO UPDATE SET %s", conflictCol, strings.Join(sets, ", "))
+	case DialectMySQL:
+		sets := make([]string, len(setCols))
+		for i, c := range setCols {
+			sets[i] = fmt.Sprintf("%s = VALUES(%s)", c, c)
+		}
+		return fmt.Sprintf("ON DUPLICATE KEY UPDATE %s", strings.Join(sets, ", "))
+	default:
+		return ""
+	}
+}